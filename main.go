@@ -2,17 +2,22 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	bot "github.com/meinside/telegram-bot-go"
 )
@@ -21,37 +26,73 @@ const (
 	// for monitoring
 	defaultMonitorIntervalSeconds = 3
 
+	// for rate limiting and the job queue
+	defaultMaxConcurrentJobs = 2
+	defaultRequestsPerMinute = 10
+	jobQueueSize             = 64
+
 	// commands
 	commandStart        = "/start"
 	commandPreset       = "/preset"
 	commandChangePreset = "/presetchange"
 	commandHelp         = "/help"
 	commandCancel       = "/cancel"
+	commandNewPreset    = "/newpreset"
+	commandDelPreset    = "/delpreset"
+	commandMyPresets    = "/mypresets"
+	commandChain        = "/chain"
+	commandPreview      = "/preview"
 
 	// messages
-	messageDefault          = "Record your voice to start."
-	messageSelectPreset     = "Select a preset."
-	messageNoPreset         = "No preset available."
-	messageNoMatchingPreset = "No such preset"
-	messagePresetChanged    = "Applied preset"
-	messagePresetNotSet     = "Preset not set"
-	messageUnknownCommand   = "Unknown command"
-	messageCancel           = "Cancel"
-	messageCanceled         = "Canceled."
+	messageDefault              = "Record your voice to start."
+	messageSelectPreset         = "Select a preset."
+	messageNoPreset             = "No preset available."
+	messageNoMatchingPreset     = "No such preset"
+	messagePresetChanged        = "Applied preset"
+	messagePresetNotSet         = "Preset not set"
+	messageUnknownCommand       = "Unknown command"
+	messageCancel               = "Cancel"
+	messageCanceled             = "Canceled."
+	messagePresetSaved          = "Saved preset"
+	messagePresetDeleted        = "Deleted preset"
+	messageNoSuchUserPreset     = "No such preset of yours"
+	messageNoUserPresets        = "You have no presets of your own."
+	messageNewPresetUsage       = "Usage: /newpreset <name> <sox args...>"
+	messageDelPresetUsage       = "Usage: /delpreset <name>"
+	messageChainUsage           = "Usage: /chain <preset1> <preset2> ..."
+	messageChainSet             = "Chain set"
+	messagePreviewOn            = "Preview mode on: following voices will be sent back with every preset applied."
+	messagePreviewOff           = "Preview mode off"
+	messageRateLimited          = "Too many requests. Please wait a bit and try again."
+	messageQueueFull            = "Busy processing other requests. Please try again shortly."
+	messageNothingToCancel      = "Nothing to cancel."
+	messageJobInProgress        = "You already have a conversion in progress. Please wait for it to finish, or /cancel it."
+	messageNewPresetInvalidArgs = "Preset args must start with a known sox effect name, and may only contain known sox effect names and numeric parameters."
 )
 
 type session struct {
 	UserID         string
 	SelectedPreset string
+	Chain          []string // preset names to apply in sequence, set via /chain and cleared when a preset is selected
+	Preview        bool     // if true, each following voice is converted with every available preset
+	RecentVoices   []string // LRU (most-recent-first) of incoming file_ids, for inline-mode lookups
 }
 
+// how many recently-processed voices to remember per user, for inline-mode lookups
+const recentVoicesLimit = 5
+
 type sessionPool struct {
-	Sessions map[string]session
+	Sessions     map[string]session
+	UserPresets  map[string]map[string][]string // userID -> preset name -> sox args
+	UserLocks    map[string]*sync.Mutex         // userID -> lock serializing that user's own conversions
+	RateLimiters map[string]*tokenBucket        // userID -> rate limiter
+	CancelFuncs  map[string]context.CancelFunc  // userID -> cancel func of their in-flight job
 	sync.Mutex
 }
 
 const (
-	configFilename = "config.json"
+	configFilename      = "config.json"
+	userPresetsFilename = "userpresets.json"
 )
 
 // variables
@@ -62,7 +103,35 @@ var apiToken string
 var monitorInterval int
 var isVerbose bool
 var availableIds []string
+var maxConcurrentJobs int
+var requestsPerMinute int
 var pool sessionPool
+var jobsCh chan convertJob
+
+// sox effect names allowed in a user-supplied preset (`/newpreset`); sox's argv grammar is
+// positional (infile [format-opts] ... outfile [format-opts] [effect [effect-opts]]), and
+// soxConvert already fixes the input/output positions to "-", so args landing after them are
+// parsed as the effects chain, not as another file operand — but only if the first token is a
+// real effect name and every other non-numeric token here is one too, otherwise sox falls
+// through to treating it as another filename operand instead of erroring out
+var allowedSoxEffects = map[string]bool{
+	"speed": true, "pitch": true, "tempo": true, "reverb": true, "echo": true,
+	"echos": true, "chorus": true, "flanger": true, "phaser": true, "overdrive": true,
+	"bass": true, "treble": true, "gain": true, "vol": true, "compand": true,
+	"fade": true, "reverse": true, "trim": true, "pad": true, "repeat": true,
+	"delay": true, "silence": true, "loudness": true, "norm": true,
+}
+
+// isSoxEffectToken reports whether arg is safe to place after the fixed "-" input/output
+// operands in a sox invocation: either a numeric effect parameter, or a known effect name.
+// Anything else (in particular a leading "-", which sox reads as a global/format option, or
+// any other bare token, which sox would read as another file operand) is rejected.
+func isSoxEffectToken(arg string) bool {
+	if _, err := strconv.ParseFloat(arg, 64); err == nil {
+		return true
+	}
+	return allowedSoxEffects[arg]
+}
 
 // keyboards
 var allKeyboards = [][]bot.KeyboardButton{
@@ -71,12 +140,14 @@ var allKeyboards = [][]bot.KeyboardButton{
 
 // struct for config file
 type config struct {
-	SoxBinPath       string              `json:"sox_bin"`
-	SoxPresetOptions map[string][]string `json:"sox_presets"`
-	APIToken         string              `json:"api_token"`
-	AvailableIds     []string            `json:"available_ids"`
-	MonitorInterval  int                 `json:"monitor_interval"`
-	IsVerbose        bool                `json:"is_verbose"`
+	SoxBinPath        string              `json:"sox_bin"`
+	SoxPresetOptions  map[string][]string `json:"sox_presets"`
+	APIToken          string              `json:"api_token"`
+	AvailableIds      []string            `json:"available_ids"`
+	MonitorInterval   int                 `json:"monitor_interval"`
+	IsVerbose         bool                `json:"is_verbose"`
+	MaxConcurrentJobs int                 `json:"max_concurrent_jobs"`
+	RequestsPerMinute int                 `json:"requests_per_minute"`
 }
 
 // Read config
@@ -110,6 +181,14 @@ func init() {
 			monitorInterval = defaultMonitorIntervalSeconds
 		}
 		isVerbose = cfg.IsVerbose
+		maxConcurrentJobs = cfg.MaxConcurrentJobs
+		if maxConcurrentJobs <= 0 {
+			maxConcurrentJobs = defaultMaxConcurrentJobs
+		}
+		requestsPerMinute = cfg.RequestsPerMinute
+		if requestsPerMinute <= 0 {
+			requestsPerMinute = defaultRequestsPerMinute
+		}
 
 		// initialize variables
 		sessions := make(map[string]session)
@@ -118,14 +197,215 @@ func init() {
 				UserID: v,
 			}
 		}
+		userPresets, err := loadUserPresets()
+		if err != nil {
+			log.Printf("* Failed to load user presets, starting empty: %s", err)
+			userPresets = map[string]map[string][]string{}
+		}
+
 		pool = sessionPool{
-			Sessions: sessions,
+			Sessions:     sessions,
+			UserPresets:  userPresets,
+			UserLocks:    map[string]*sync.Mutex{},
+			RateLimiters: map[string]*tokenBucket{},
+			CancelFuncs:  map[string]context.CancelFunc{},
 		}
+
+		jobsCh = make(chan convertJob, jobQueueSize)
 	} else {
 		panic(err.Error())
 	}
 }
 
+// path of the file where user presets are persisted
+func userPresetsFilePath() string {
+	_, filename, _, _ := runtime.Caller(0) // = __FILE__
+
+	return filepath.Join(path.Dir(filename), userPresetsFilename)
+}
+
+// load per-user presets from disk
+func loadUserPresets() (map[string]map[string][]string, error) {
+	file, err := ioutil.ReadFile(userPresetsFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]map[string][]string{}, nil
+		}
+		return nil, err
+	}
+
+	var all map[string]map[string][]string
+	if err := json.Unmarshal(file, &all); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// save per-user presets to disk (caller must hold pool.Mutex)
+func saveUserPresets(all map[string]map[string][]string) error {
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(userPresetsFilePath(), data, 0600)
+}
+
+// merge a user's own presets over the global ones from config.json
+func mergedPresetsForUser(userID string) map[string][]string {
+	pool.Lock()
+	defer pool.Unlock()
+
+	merged := map[string][]string{}
+	for k, v := range soxPresets {
+		merged[k] = v
+	}
+	for k, v := range pool.UserPresets[userID] {
+		merged[k] = v
+	}
+	return merged
+}
+
+// token-bucket rate limiter, refilling at `requestsPerMinute` tokens per minute
+type tokenBucket struct {
+	sync.Mutex
+	tokens     float64
+	capacity   float64
+	refillRate float64 // tokens per second
+	lastRefill time.Time
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+	capacity := float64(perMinute)
+	return &tokenBucket{
+		tokens:     capacity,
+		capacity:   capacity,
+		refillRate: capacity / 60.0,
+		lastRefill: time.Now(),
+	}
+}
+
+// allow reports whether a request may proceed now, consuming a token if so
+func (t *tokenBucket) allow() bool {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	t.tokens += now.Sub(t.lastRefill).Seconds() * t.refillRate
+	if t.tokens > t.capacity {
+		t.tokens = t.capacity
+	}
+	t.lastRefill = now
+
+	if t.tokens < 1 {
+		return false
+	}
+	t.tokens--
+	return true
+}
+
+// rate limiter for a given user, created lazily
+func rateLimiterFor(userID string) *tokenBucket {
+	pool.Lock()
+	defer pool.Unlock()
+
+	limiter, exists := pool.RateLimiters[userID]
+	if !exists {
+		limiter = newTokenBucket(requestsPerMinute)
+		pool.RateLimiters[userID] = limiter
+	}
+	return limiter
+}
+
+// mutex serializing a single user's own conversions, created lazily
+func userMutex(userID string) *sync.Mutex {
+	pool.Lock()
+	defer pool.Unlock()
+
+	lock, exists := pool.UserLocks[userID]
+	if !exists {
+		lock = &sync.Mutex{}
+		pool.UserLocks[userID] = lock
+	}
+	return lock
+}
+
+// remember how to cancel a user's in-flight job, unless one is already in flight;
+// reports whether it was set, so callers can refuse to enqueue a second job per user
+func trySetCancelFunc(userID string, cancel context.CancelFunc) bool {
+	pool.Lock()
+	defer pool.Unlock()
+
+	if _, busy := pool.CancelFuncs[userID]; busy {
+		return false
+	}
+	pool.CancelFuncs[userID] = cancel
+	return true
+}
+
+// forget a user's in-flight job, without canceling it
+func clearCancelFunc(userID string) {
+	pool.Lock()
+	defer pool.Unlock()
+
+	delete(pool.CancelFuncs, userID)
+}
+
+// cancel a user's in-flight job, if there is one, caller must hold no locks
+func handleCancel(userID string) string {
+	pool.Lock()
+	cancel, exists := pool.CancelFuncs[userID]
+	if exists {
+		delete(pool.CancelFuncs, userID)
+	}
+	pool.Unlock()
+
+	if !exists {
+		return messageNothingToCancel
+	}
+	cancel()
+	return messageCanceled
+}
+
+// push a newly-seen voice/audio file_id to the front of a user's recent-voices LRU
+func pushRecentVoice(recent []string, fileID string) []string {
+	updated := []string{fileID}
+	for _, id := range recent {
+		if id != fileID {
+			updated = append(updated, id)
+		}
+	}
+	if len(updated) > recentVoicesLimit {
+		updated = updated[:recentVoicesLimit]
+	}
+	return updated
+}
+
+// cache of telegram voice file_ids produced by earlier conversions, so inline-mode queries resolve instantly
+var voiceFileIDCache = struct {
+	sync.Mutex
+	m map[string]map[string]string // source file_id -> preset name -> converted voice's telegram file_id
+}{m: map[string]map[string]string{}}
+
+// remember the telegram file_id of a voice converted from sourceFileID with the given preset
+func cacheVoiceFileID(sourceFileID, preset, voiceFileID string) {
+	voiceFileIDCache.Lock()
+	defer voiceFileIDCache.Unlock()
+
+	if voiceFileIDCache.m[sourceFileID] == nil {
+		voiceFileIDCache.m[sourceFileID] = map[string]string{}
+	}
+	voiceFileIDCache.m[sourceFileID][preset] = voiceFileID
+}
+
+// look up a previously-converted voice's telegram file_id, if any
+func lookupVoiceFileID(sourceFileID, preset string) (string, bool) {
+	voiceFileIDCache.Lock()
+	defer voiceFileIDCache.Unlock()
+
+	voiceFileID, exists := voiceFileIDCache.m[sourceFileID][preset]
+	return voiceFileID, exists
+}
+
 // check if given Telegram id is available
 func isAvailableID(id string) bool {
 	for _, v := range availableIds {
@@ -139,13 +419,276 @@ func isAvailableID(id string) bool {
 // for showing help message
 func getHelp() string {
 	return `
+Send a voice, audio, video note, or audio document to convert it.
+
 Following commands are supported:
 
 /preset: change preset
+/newpreset <name> <sox args...> : save a preset of your own
+/delpreset <name> : delete a preset of your own
+/mypresets : list your own presets
+/chain <preset1> <preset2> ... : apply several presets in sequence to following voices
+/preview : toggle sending following voices back with every preset applied
 /help : show this help message
+
+In any chat, type @<bot username> <preset> to send a previously-converted voice of yours inline.
 `
 }
 
+// save a new preset of the user's own
+func handleNewPreset(userID, txt string) string {
+	fields := strings.Fields(strings.TrimPrefix(txt, commandNewPreset))
+	if len(fields) < 2 {
+		return messageNewPresetUsage
+	}
+	name, args := fields[0], fields[1:]
+	// the first token must be an effect name, or sox would read it as another file operand
+	if !allowedSoxEffects[args[0]] {
+		return messageNewPresetInvalidArgs
+	}
+	for _, arg := range args {
+		if !isSoxEffectToken(arg) {
+			return messageNewPresetInvalidArgs
+		}
+	}
+
+	pool.Lock()
+	if pool.UserPresets[userID] == nil {
+		pool.UserPresets[userID] = map[string][]string{}
+	}
+	pool.UserPresets[userID][name] = args
+	err := saveUserPresets(pool.UserPresets)
+	pool.Unlock()
+
+	if err != nil {
+		log.Printf("*** Failed to save user presets: %s", err)
+	}
+
+	return fmt.Sprintf("%s: %s (%s)", messagePresetSaved, name, strings.Join(args, " "))
+}
+
+// delete a preset of the user's own
+func handleDelPreset(userID, txt string) string {
+	name := strings.TrimSpace(strings.TrimPrefix(txt, commandDelPreset))
+	if len(name) == 0 {
+		return messageDelPresetUsage
+	}
+
+	pool.Lock()
+	if _, exists := pool.UserPresets[userID][name]; !exists {
+		pool.Unlock()
+		return fmt.Sprintf("%s: %s", messageNoSuchUserPreset, name)
+	}
+	delete(pool.UserPresets[userID], name)
+	err := saveUserPresets(pool.UserPresets)
+	pool.Unlock()
+
+	if err != nil {
+		log.Printf("*** Failed to save user presets: %s", err)
+	}
+
+	return fmt.Sprintf("%s: %s", messagePresetDeleted, name)
+}
+
+// list presets of the user's own
+func handleMyPresets(userID string) string {
+	pool.Lock()
+	presets := pool.UserPresets[userID]
+	pool.Unlock()
+
+	if len(presets) == 0 {
+		return messageNoUserPresets
+	}
+
+	lines := []string{}
+	for name, args := range presets {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, strings.Join(args, " ")))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// concatenate the sox arguments of the given presets, in order
+func buildChainArgs(names []string, presets map[string][]string) ([]string, error) {
+	args := []string{}
+	for _, name := range names {
+		p, exists := presets[name]
+		if !exists {
+			return nil, fmt.Errorf("no such preset: %s", name)
+		}
+		args = append(args, p...)
+	}
+	return args, nil
+}
+
+// set the chain of presets to apply to following voices
+func handleChain(userID, txt string, presets map[string][]string) string {
+	names := strings.Fields(strings.TrimPrefix(txt, commandChain))
+	if len(names) == 0 {
+		return messageChainUsage
+	}
+
+	if _, err := buildChainArgs(names, presets); err != nil {
+		return err.Error()
+	}
+
+	pool.Lock()
+	session := pool.Sessions[userID]
+	session.Chain = names
+	pool.Sessions[userID] = session
+	pool.Unlock()
+
+	return fmt.Sprintf("%s: %s", messageChainSet, strings.Join(names, " -> "))
+}
+
+// toggle preview mode for following voices
+func handlePreview(userID string) string {
+	pool.Lock()
+	session := pool.Sessions[userID]
+	session.Preview = !session.Preview
+	pool.Sessions[userID] = session
+	pool.Unlock()
+
+	if session.Preview {
+		return messagePreviewOn
+	}
+	return messagePreviewOff
+}
+
+// reply options common to every text reply
+func baseReplyOptions() map[string]interface{} {
+	return map[string]interface{}{
+		"reply_markup": bot.ReplyKeyboardMarkup{
+			Keyboard:       allKeyboards,
+			ResizeKeyboard: true,
+		},
+		//"parse_mode": bot.ParseModeMarkdown,
+	}
+}
+
+// a queued sox conversion, dispatched to a worker by processUpdate
+type convertJob struct {
+	ctx     context.Context
+	b       *bot.Bot
+	userID  string
+	chatID  int64
+	fileID  string
+	isVoice bool
+	preview bool
+	names   []string // preset chain to apply; ignored when preview is true
+	label   string   // human-readable label for the chain, for the caption
+	presets map[string][]string
+}
+
+// start `n` workers consuming queued conversion jobs, bounding how many sox processes run at once
+func startJobWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for job := range jobsCh {
+				processConvertJob(job)
+			}
+		}()
+	}
+}
+
+// run a queued conversion job and send its result(s) back, serialized per user
+func processConvertJob(job convertJob) {
+	defer clearCancelFunc(job.userID)
+
+	lock := userMutex(job.userID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	options := baseReplyOptions()
+
+	if job.preview {
+		// preview mode: send back every preset as a separate voice/audio
+		names := make([]string, 0, len(job.presets))
+		for name := range job.presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		variants, err := synthesizeVoiceVariants(job.ctx, job.b, job.fileID, job.isVoice, names, job.presets)
+		if err != nil {
+			log.Printf("*** Voice synthesis failed: %s", err)
+			job.b.SendMessage(job.chatID, fmt.Sprintf("Failed to synthesize voice: %s", err.Error()), options)
+			return
+		}
+
+		job.b.SendChatAction(job.chatID, bot.ChatActionUploadAudio)
+		for _, name := range names {
+			variantOptions := map[string]interface{}{
+				"caption": fmt.Sprintf("%s (%s)", name, strings.Join(job.presets[name], " ")),
+			}
+			if voiceFileID, sent := sendConverted(job.b, job.chatID, job.isVoice, variants[name], variantOptions); sent && job.isVoice {
+				cacheVoiceFileID(job.fileID, name, voiceFileID)
+			}
+		}
+		return
+	}
+
+	// single preset or a chain of presets
+	data, err := synthesizeVoiceWithFileID(job.ctx, job.b, job.fileID, job.isVoice, job.names, job.presets)
+	if err != nil {
+		log.Printf("*** Voice synthesis failed: %s", err)
+		job.b.SendMessage(job.chatID, fmt.Sprintf("Failed to synthesize voice: %s", err.Error()), options)
+		return
+	}
+
+	job.b.SendChatAction(job.chatID, bot.ChatActionUploadAudio)
+
+	// voice caption
+	if len(job.label) > 0 {
+		args, _ := buildChainArgs(job.names, job.presets)
+		options["caption"] = fmt.Sprintf("%s (%s)", job.label, strings.Join(args, " "))
+	} else {
+		options["caption"] = messagePresetNotSet
+	}
+
+	if voiceFileID, sent := sendConverted(job.b, job.chatID, job.isVoice, data, options); sent && job.isVoice && len(job.names) == 1 {
+		// only standalone presets (not chains) are cached, since inline mode offers one entry per preset name
+		cacheVoiceFileID(job.fileID, job.names[0], voiceFileID)
+	}
+}
+
+// pick the file_id of the convertible media attached to a message, if any
+//
+// voice notes are sent back as voice replies, everything else (audio, documents, video notes)
+// is sent back as an audio file
+func resolveIncomingFileID(msg *bot.Message) (fileID string, isVoice bool, ok bool) {
+	switch {
+	case msg.HasVoice():
+		return msg.Voice.FileID, true, true
+	case msg.HasAudio():
+		return msg.Audio.FileID, false, true
+	case msg.HasVideoNote():
+		return msg.VideoNote.FileID, false, true
+	case msg.HasDocument():
+		return msg.Document.FileID, false, true
+	}
+	return "", false, false
+}
+
+// send converted media back, as a voice reply or as an audio file;
+// returns the telegram file_id of the sent voice, for inline-mode caching
+func sendConverted(b *bot.Bot, chatID int64, isVoice bool, data []byte, options map[string]interface{}) (voiceFileID string, ok bool) {
+	if isVoice {
+		sent := b.SendVoice(chatID, bot.InputFileFromBytes(data), options)
+		if sent.Ok {
+			return sent.Result.Voice.FileID, true
+		}
+		log.Printf("*** Failed to send converted media: %s", *sent.Description)
+		return "", false
+	}
+
+	sent := b.SendAudio(chatID, bot.InputFileFromBytes(data), options)
+	if sent.Ok {
+		return "", true
+	}
+	log.Printf("*** Failed to send converted media: %s", *sent.Description)
+	return "", false
+}
+
 // process incoming update from Telegram
 func processUpdate(b *bot.Bot, update bot.Update) bool {
 	// check username
@@ -160,98 +703,128 @@ func processUpdate(b *bot.Bot, update bot.Update) bool {
 		return false
 	}
 
-	// process result
-	result := false
-
 	pool.Lock()
-	if session, exists := pool.Sessions[userID]; exists {
-		// text from message
-		var txt string
-		if update.Message.HasText() {
-			txt = *update.Message.Text
-		} else {
-			txt = ""
+	sess, exists := pool.Sessions[userID]
+	pool.Unlock()
+	if !exists {
+		log.Printf("*** Session does not exist for id: %s", userID)
+		return false
+	}
+
+	if fileID, isVoice, hasMedia := resolveIncomingFileID(update.Message); hasMedia {
+		if !rateLimiterFor(userID).allow() {
+			b.SendMessage(update.Message.Chat.ID, messageRateLimited, baseReplyOptions())
+			return false
 		}
 
-		var message string
-		var options = map[string]interface{}{
-			"reply_markup": bot.ReplyKeyboardMarkup{
-				Keyboard:       allKeyboards,
-				ResizeKeyboard: true,
-			},
-			//"parse_mode": bot.ParseModeMarkdown,
+		// recording voice...
+		b.SendChatAction(update.Message.Chat.ID, bot.ChatActionRecordAudio)
+
+		names, label := []string{sess.SelectedPreset}, sess.SelectedPreset
+		if len(sess.Chain) > 0 {
+			names, label = sess.Chain, strings.Join(sess.Chain, " -> ")
 		}
 
-		if update.Message.HasVoice() {
-			// recording voice...
-			b.SendChatAction(update.Message.Chat.ID, bot.ChatActionRecordAudio)
+		ctx, cancel := context.WithCancel(context.Background())
+		if !trySetCancelFunc(userID, cancel) {
+			cancel()
+			b.SendMessage(update.Message.Chat.ID, messageJobInProgress, baseReplyOptions())
+			return false
+		}
 
-			// send synthesized voice
-			if data, err := synthesizeVoiceWithFileID(b, update.Message.Voice.FileID, session.SelectedPreset); err == nil {
-				// uploading voice...
-				b.SendChatAction(update.Message.Chat.ID, bot.ChatActionUploadAudio)
+		job := convertJob{
+			ctx:     ctx,
+			b:       b,
+			userID:  userID,
+			chatID:  update.Message.Chat.ID,
+			fileID:  fileID,
+			isVoice: isVoice,
+			preview: sess.Preview,
+			names:   names,
+			label:   label,
+			presets: mergedPresetsForUser(userID),
+		}
 
-				// voice caption
-				if len(session.SelectedPreset) > 0 {
-					options["caption"] = fmt.Sprintf("%s (%s)", session.SelectedPreset, strings.Join(soxPresets[session.SelectedPreset], " "))
-				} else {
-					options["caption"] = messagePresetNotSet
-				}
+		// dispatch to the bounded worker pool, without blocking update polling
+		select {
+		case jobsCh <- job:
+			// only remember file_ids of jobs actually dispatched; inline mode skips those with no cached conversion
+			pool.Lock()
+			sess.RecentVoices = pushRecentVoice(sess.RecentVoices, fileID)
+			pool.Sessions[userID] = sess
+			pool.Unlock()
+			return true
+		default:
+			cancel()
+			clearCancelFunc(userID)
+			b.SendMessage(update.Message.Chat.ID, messageQueueFull, baseReplyOptions())
+			return false
+		}
+	}
 
-				// upload voice
-				if sent := b.SendVoice(update.Message.Chat.ID, bot.InputFileFromBytes(data), options); sent.Ok {
-					result = true
-				} else {
-					log.Printf("*** Failed to send photo: %s", *sent.Description)
-				}
-			} else {
-				log.Printf("*** Voice synthesis failed: %s", err)
+	// text from message
+	var txt string
+	if update.Message.HasText() {
+		txt = *update.Message.Text
+	}
 
-				message = fmt.Sprintf("Failed to synthesize voice: %s", err.Error())
-				b.SendMessage(update.Message.Chat.ID, message, options)
-			}
-		} else {
-			switch {
-			// start
-			case strings.HasPrefix(txt, commandStart):
-				message = messageDefault
-			case strings.HasPrefix(txt, commandPreset):
-				if len(soxPresets) > 0 {
-					message = messageSelectPreset
-
-					keys := map[string]string{}
-					for k := range soxPresets {
-						keys[k] = fmt.Sprintf("%s %s", commandChangePreset, k)
-					}
-					keys[messageCancel] = commandCancel
+	var message string
+	options := baseReplyOptions()
 
-					options["reply_markup"] = bot.InlineKeyboardMarkup{
-						InlineKeyboard: bot.NewInlineKeyboardButtonsAsRowsWithCallbackData(keys),
-					}
-				} else {
-					message = messageNoPreset
-				}
-			// help
-			case strings.HasPrefix(txt, commandHelp):
-				message = getHelp()
-			// fallback
-			default:
-				message = fmt.Sprintf("%s: %s", messageUnknownCommand, txt)
+	switch {
+	// start
+	case strings.HasPrefix(txt, commandStart):
+		message = messageDefault
+	case strings.HasPrefix(txt, commandPreset):
+		presets := mergedPresetsForUser(userID)
+		if len(presets) > 0 {
+			message = messageSelectPreset
+
+			keys := map[string]string{}
+			for k := range presets {
+				keys[k] = fmt.Sprintf("%s %s", commandChangePreset, k)
 			}
+			keys[messageCancel] = commandCancel
 
-			// send message
-			if sent := b.SendMessage(update.Message.Chat.ID, message, options); sent.Ok {
-				result = true
-			} else {
-				log.Printf("*** Failed to send message: %s", *sent.Description)
+			options["reply_markup"] = bot.InlineKeyboardMarkup{
+				InlineKeyboard: bot.NewInlineKeyboardButtonsAsRowsWithCallbackData(keys),
 			}
+		} else {
+			message = messageNoPreset
 		}
-	} else {
-		log.Printf("*** Session does not exist for id: %s", userID)
+	// save a preset of the user's own
+	case strings.HasPrefix(txt, commandNewPreset):
+		message = handleNewPreset(userID, txt)
+	// delete a preset of the user's own
+	case strings.HasPrefix(txt, commandDelPreset):
+		message = handleDelPreset(userID, txt)
+	// list presets of the user's own
+	case strings.HasPrefix(txt, commandMyPresets):
+		message = handleMyPresets(userID)
+	// chain several presets together for following voices
+	case strings.HasPrefix(txt, commandChain):
+		message = handleChain(userID, txt, mergedPresetsForUser(userID))
+	// toggle preview mode for following voices
+	case strings.HasPrefix(txt, commandPreview):
+		message = handlePreview(userID)
+	// cancel the in-flight job, if any
+	case strings.HasPrefix(txt, commandCancel):
+		message = handleCancel(userID)
+	// help
+	case strings.HasPrefix(txt, commandHelp):
+		message = getHelp()
+	// fallback
+	default:
+		message = fmt.Sprintf("%s: %s", messageUnknownCommand, txt)
 	}
-	pool.Unlock()
 
-	return result
+	// send message
+	if sent := b.SendMessage(update.Message.Chat.ID, message, options); sent.Ok {
+		return true
+	} else {
+		log.Printf("*** Failed to send message: %s", *sent.Description)
+	}
+	return false
 }
 
 // process incoming callback query
@@ -265,22 +838,30 @@ func processCallbackQuery(b *bot.Bot, update bot.Update) bool {
 	var message string
 	if strings.HasPrefix(txt, commandChangePreset) {
 		preset := strings.TrimSpace(strings.TrimPrefix(txt, commandChangePreset))
-
-		if _, exists := soxPresets[preset]; exists {
+		if query.From.Username == nil {
+			log.Printf("*** Not allowed (no user name): %s", query.From.FirstName)
+		} else {
 			userID := *query.From.Username
-			if !isAvailableID(userID) {
-				log.Printf("*** Id not allowed: %s", userID)
-			} else {
-				// change preset
-				pool.Sessions[userID] = session{
-					UserID:         userID,
-					SelectedPreset: preset,
-				}
+			presets := mergedPresetsForUser(userID)
+
+			if _, exists := presets[preset]; exists {
+				if !isAvailableID(userID) {
+					log.Printf("*** Id not allowed: %s", userID)
+				} else {
+					// change preset, replacing any chain but keeping the rest of the session
+					pool.Lock()
+					sess := pool.Sessions[userID]
+					sess.UserID = userID
+					sess.SelectedPreset = preset
+					sess.Chain = nil
+					pool.Sessions[userID] = sess
+					pool.Unlock()
 
-				message = fmt.Sprintf("%s: %s", messagePresetChanged, preset)
+					message = fmt.Sprintf("%s: %s", messagePresetChanged, preset)
+				}
+			} else {
+				message = fmt.Sprintf("%s: %s", messageNoMatchingPreset, preset)
 			}
-		} else {
-			message = fmt.Sprintf("%s: %s", messageNoMatchingPreset, preset)
 		}
 	} else if strings.HasPrefix(txt, commandCancel) {
 		message = messageCanceled
@@ -309,30 +890,145 @@ func processCallbackQuery(b *bot.Bot, update bot.Update) bool {
 	return result
 }
 
-// synthesize voice from given file_id
-func synthesizeVoiceWithFileID(b *bot.Bot, fileID string, preset string) ([]byte, error) {
+// process incoming inline query: offer previously-converted, cached voices for the user's most recent upload
+func processInlineQuery(b *bot.Bot, update bot.Update) bool {
+	query := *update.InlineQuery
+
+	if query.From.Username == nil {
+		return false
+	}
+	userID := *query.From.Username
+	if !isAvailableID(userID) {
+		log.Printf("*** Id not allowed: %s", userID)
+		return false
+	}
+
+	pool.Lock()
+	sess, exists := pool.Sessions[userID]
+	pool.Unlock()
+
+	results := []interface{}{}
+	if exists {
+		filter := strings.TrimSpace(query.Query)
+
+		presets := mergedPresetsForUser(userID)
+		names := make([]string, 0, len(presets))
+		for name := range presets {
+			if filter == "" || strings.HasPrefix(name, filter) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		// walk the LRU newest-first until we find an upload with any pre-rendered conversions;
+		// the most recent one is often uncached (eg. a /chain result, which isn't cached at all)
+		for _, sourceFileID := range sess.RecentVoices {
+			for _, name := range names {
+				voiceFileID, cached := lookupVoiceFileID(sourceFileID, name)
+				if !cached {
+					// not rendered yet; only pre-rendered conversions can resolve instantly
+					continue
+				}
+				results = append(results, bot.InlineQueryResultCachedVoice{
+					InlineQueryResult: bot.InlineQueryResult{
+						Type: "voice",
+						ID:   fmt.Sprintf("%s:%s", sourceFileID, name),
+					},
+					VoiceFileID: voiceFileID,
+					Title:       name,
+				})
+			}
+			if len(results) > 0 {
+				break
+			}
+		}
+	}
+
+	answered := b.AnswerInlineQuery(query.ID, results, map[string]interface{}{})
+	if !answered.Ok {
+		log.Printf("*** Failed to answer inline query: %s", *answered.Description)
+		return false
+	}
+	return true
+}
+
+// download the raw bytes of given file_id
+func fetchFileBytes(ctx context.Context, b *bot.Bot, fileID string) ([]byte, error) {
 	f := b.GetFile(fileID)
 	if f.Ok {
-		res, err := http.Get(b.GetFileURL(*f.Result))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.GetFileURL(*f.Result), nil)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		res, err := http.DefaultClient.Do(req)
 		if err == nil {
 			defer res.Body.Close()
 
-			// get bytes of given voice file
-			data, err := ioutil.ReadAll(res.Body)
-			if err == nil {
-				return soxConvert(data, preset)
-			}
-			return []byte{}, err
+			return ioutil.ReadAll(res.Body)
 		}
 		return []byte{}, err
 	}
 	return []byte{}, fmt.Errorf("Failed to get file: %s", *f.Description)
 }
 
-// convert given bytes using sox and preset
+// guess the sox input type (`-t` flag) from the container sniffed out of the downloaded bytes
+//
+// voice notes are always opus-in-ogg, but so is arbitrary ogg/vorbis audio sent as a document,
+// and sox's ogg/vorbis reader can't be trusted to decode an opus stream, so isVoice forces the
+// correct flag rather than relying on content-sniffing for that path
+func soxInputTypeForData(data []byte, isVoice bool) string {
+	if isVoice {
+		return "opus"
+	}
+	switch http.DetectContentType(data) {
+	case "audio/mpeg":
+		return "mp3"
+	case "audio/wave", "audio/wav", "audio/x-wav":
+		return "wav"
+	case "audio/flac", "audio/x-flac":
+		return "flac"
+	case "video/mp4":
+		return "m4a"
+	case "application/ogg":
+		return "ogg"
+	default:
+		return "opus"
+	}
+}
+
+// synthesize voice from given file_id, applying the given chain of presets (resolved from the given, merged presets) in sequence
+func synthesizeVoiceWithFileID(ctx context.Context, b *bot.Bot, fileID string, isVoice bool, presetNames []string, presets map[string][]string) ([]byte, error) {
+	data, err := fetchFileBytes(ctx, b, fileID)
+	if err != nil {
+		return []byte{}, err
+	}
+	return soxConvert(ctx, data, soxInputTypeForData(data, isVoice), presetNames, presets)
+}
+
+// synthesize voice from given file_id once per preset, returning each converted result keyed by preset name
+func synthesizeVoiceVariants(ctx context.Context, b *bot.Bot, fileID string, isVoice bool, presetNames []string, presets map[string][]string) (map[string][]byte, error) {
+	data, err := fetchFileBytes(ctx, b, fileID)
+	if err != nil {
+		return nil, err
+	}
+	inputType := soxInputTypeForData(data, isVoice)
+
+	variants := map[string][]byte{}
+	for _, name := range presetNames {
+		converted, err := soxConvert(ctx, data, inputType, []string{name}, presets)
+		if err != nil {
+			return nil, err
+		}
+		variants[name] = converted
+	}
+	return variants, nil
+}
+
+// convert given bytes using sox, applying the given chain of presets (resolved from the given, merged presets) in sequence
 //
 // eg) $ cat "original.oga" | sox -t opus - -t ogg - speed 2.0 > "converted.ogg"
-func soxConvert(original []byte, preset string) ([]byte, error) {
+func soxConvert(ctx context.Context, original []byte, inputType string, presetNames []string, presets map[string][]string) ([]byte, error) {
 	if isVerbose {
 		log.Printf("Received: %s (%d bytes)", http.DetectContentType(original), len(original))
 	}
@@ -340,19 +1036,19 @@ func soxConvert(original []byte, preset string) ([]byte, error) {
 	// command line arguments
 	args := []string{
 		// default arguments
-		"-t", "opus", "-", // input from stdin
+		"-t", inputType, "-", // input from stdin
 		"-t", "ogg", "-", // output to stdout
 	}
-	// presets as additional arguments
-	if p, exists := soxPresets[preset]; exists {
-		args = append(args, p...)
+	// chained presets as additional arguments
+	if chainArgs, err := buildChainArgs(presetNames, presets); err == nil && len(chainArgs) > 0 {
+		args = append(args, chainArgs...)
 	} else {
 		args = append(args, soxDefaultPreset...)
 	}
 
-	// execute command
+	// execute command, cancelable via /cancel
 	out, errs := &bytes.Buffer{}, &bytes.Buffer{}
-	cmd := exec.Command(soxPath, args...)
+	cmd := exec.CommandContext(ctx, soxPath, args...)
 	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(original), out, errs
 	err := cmd.Run()
 	if err == nil {
@@ -362,6 +1058,8 @@ func soxConvert(original []byte, preset string) ([]byte, error) {
 }
 
 func main() {
+	startJobWorkers(maxConcurrentJobs)
+
 	client := bot.NewClient(apiToken)
 	client.Verbose = isVerbose
 
@@ -378,6 +1076,8 @@ func main() {
 						processUpdate(b, update)
 					} else if update.HasCallbackQuery() {
 						processCallbackQuery(b, update)
+					} else if update.HasInlineQuery() {
+						processInlineQuery(b, update)
 					}
 				} else {
 					log.Printf("*** Error while receiving update (%s)", err.Error())